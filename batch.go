@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+// maxBatchGetWorkers bounds how many SELECTs IncrementAndGetBatch issues
+// concurrently while reading back a batch's counters.
+const maxBatchGetWorkers = 16
+
+// IncrementAndGetBatch increments every named counter in a single counter
+// batch, then reads the resulting values back. Counter batches may not mix
+// with logged/unlogged statements, so the increments all go out as one
+// gocql.CounterBatch round-trip; the reads are not batchable the same way
+// and are instead fanned out across a bounded worker pool.
+func (c *cassandraDB) IncrementAndGetBatch(names []string) ([]Counter, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	observer := newQueryLogger(c.metrics)
+
+	// Like IncrementAndGet, the counter batch is not idempotent, so it is
+	// issued once against whichever session is current right now rather
+	// than through withSession: retrying it across a session transition
+	// would risk re-executing it and double-counting.
+	if err := c.incrementBatch(c.supervisor.Session(), names, observer); err != nil {
+		return nil, fmt.Errorf("error incrementing batch of %d counters: %s", len(names), err)
+	}
+
+	return c.getBatch(names)
+}
+
+func (c *cassandraDB) incrementBatch(session *gocql.Session, names []string, observer *queryLogger) error {
+	batch := session.NewBatch(gocql.CounterBatch)
+	batch.Observer(observer)
+	batch.RetryPolicy(c.retryPolicy)
+	for _, name := range names {
+		batch.Query(`UPDATE counter SET value=value+1 WHERE name = ?`, name)
+	}
+	return session.ExecuteBatch(batch)
+}
+
+// getBatch reads back one counter per name, bounding concurrency to
+// maxBatchGetWorkers. The increments have already committed by this point,
+// so a failed read is reported as a partial failure via BatchError rather
+// than discarding the counters that were read successfully.
+//
+// Each goroutine gets its own *queryLogger, the same way IncrementAndGet
+// does: sharing a single observer across the concurrent SELECTs would race
+// on its stats slice and, since every Counter would point at the same
+// growing aggregate, report every other counter's stats alongside its own.
+//
+// Each get is idempotent, so each goroutine retries across a session
+// transition via withSession on its own, rather than sharing one session
+// fetched up front.
+func (c *cassandraDB) getBatch(names []string) ([]Counter, error) {
+	counters := make([]Counter, len(names))
+	errs := make([]error, len(names))
+
+	sem := make(chan struct{}, maxBatchGetWorkers)
+	var wg sync.WaitGroup
+
+	for i, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			observer := newQueryLogger(c.metrics)
+			var count int64
+			err := c.supervisor.withSession(func(session *gocql.Session) error {
+				var err error
+				count, err = c.get(session, name, observer)
+				return err
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("error getting %q: %s", name, err)
+				return
+			}
+			counters[i] = Counter{Value: count, Name: name, Host: c.hostname, DBStats: observer.stats}
+		}(i, name)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return counters, &BatchError{Errs: failed}
+	}
+	return counters, nil
+}
+
+// BatchError aggregates the per-counter failures from IncrementAndGetBatch's
+// read fan-out. Callers that want the counters which did succeed can still
+// use the returned []Counter alongside this error; failed entries are left
+// as their zero value.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of the batch's counters failed to read: %v", len(e.Errs), e.Errs)
+}
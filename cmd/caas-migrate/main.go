@@ -0,0 +1,101 @@
+// Command caas-migrate applies or inspects the caas keyspace's schema
+// migrations without starting the caas server itself.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gocql/gocql"
+
+	"github.com/timo672009/caas/migrations"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: caas-migrate <up|down|force <version>|version>")
+	}
+
+	addr := os.Getenv("CASSANDRA_ADDRESS")
+	if addr == "" {
+		return fmt.Errorf("CASSANDRA_ADDRESS must be set")
+	}
+	keyspace := os.Getenv("CASSANDRA_KEYSPACE")
+	if keyspace == "" {
+		keyspace = "caas"
+	}
+
+	ips, err := net.LookupHost(addr)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s: %s", addr, err)
+	}
+
+	if err := createKeyspace(ips, keyspace); err != nil {
+		return err
+	}
+
+	cluster := gocql.NewCluster(ips...)
+	cluster.Keyspace = keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return fmt.Errorf("connecting to cassandra: %s", err)
+	}
+	defer session.Close()
+
+	m := migrations.New(session, keyspace)
+
+	switch cmd := args[0]; cmd {
+	case "up":
+		return m.Up()
+	case "down":
+		return m.Down()
+	case "force":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: caas-migrate force <version>")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %s", args[1], err)
+		}
+		return m.Force(version)
+	case "version":
+		version, err := m.Version()
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// createKeyspace mirrors db.go's createKeyspace: it connects without a
+// keyspace set, since the target keyspace doesn't exist yet on a fresh
+// cluster, and caas-migrate up is the tool meant to bootstrap it.
+func createKeyspace(ips []string, keyspace string) error {
+	cluster := gocql.NewCluster(ips...)
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return fmt.Errorf("connecting to cassandra: %s", err)
+	}
+	defer session.Close()
+
+	cql := fmt.Sprintf(
+		"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor' : 3};",
+		keyspace,
+	)
+	if err := session.Query(cql).Exec(); err != nil {
+		return fmt.Errorf("creating keyspace %s: %s", keyspace, err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/gocql/gocql"
+)
+
+// TLSConfig holds the settings needed to establish a TLS connection to
+// Cassandra, mirroring the options exposed by gocql.SslOptions.
+type TLSConfig struct {
+	Enabled bool
+
+	CAPath   string
+	CertPath string
+	KeyPath  string
+
+	// EnableHostVerification controls whether the server certificate's
+	// hostname is validated against the dialed address.
+	EnableHostVerification bool
+}
+
+// AuthConfig holds PasswordAuthenticator credentials.
+type AuthConfig struct {
+	Username string
+	Password string
+}
+
+// Config describes everything needed to connect to and tune a Cassandra
+// cluster for caas. It is built from the environment in NewCassandra, but
+// can be constructed directly (e.g. in tests, or by operators embedding
+// caas) and passed to NewCassandraWithConfig.
+type Config struct {
+	// Addresses are the initial contact points for the cluster. They must
+	// not be empty: NewCassandraWithConfig returns an error if they are.
+	// NewCassandra fills them from CASSANDRA_ADDRESS.
+	Addresses []string
+	Port      int
+
+	Keyspace string
+
+	// ReplicationClass and ReplicationFactor are only used when the
+	// keyspace does not already exist.
+	ReplicationClass  string
+	ReplicationFactor int
+
+	Consistency gocql.Consistency
+
+	NumConns      int
+	ProtoVersion  int
+	HostSelection gocql.HostSelectionPolicy
+
+	TLS     TLSConfig
+	Auth    AuthConfig
+	Retry   RetryConfig
+	Metrics MetricsConfig
+
+	// DisableInitialHostLookup skips the driver's own peer discovery,
+	// which is required for some managed/NAT'd Cassandra deployments.
+	DisableInitialHostLookup bool
+}
+
+// defaultConfig returns the values caas has historically hard-coded, so
+// that NewCassandra keeps behaving the same way unless an operator opts
+// into new env vars.
+func defaultConfig() Config {
+	return Config{
+		Port:              9042,
+		Keyspace:          "caas",
+		ReplicationClass:  "SimpleStrategy",
+		ReplicationFactor: 3,
+		Consistency:       gocql.Quorum,
+		NumConns:          2,
+		ProtoVersion:      4,
+		HostSelection:     gocql.RoundRobinHostPolicy(),
+		Retry:             defaultRetryConfig(),
+	}
+}
+
+// configFromEnv builds a Config from the environment, preserving the
+// variables caas already reads (CASSANDRA_ADDRESS) and adding the new
+// tuning knobs as optional overrides on top of defaultConfig.
+func configFromEnv() (Config, error) {
+	cfg := defaultConfig()
+
+	addr := os.Getenv("CASSANDRA_ADDRESS")
+	if addr == "" {
+		return Config{}, fmt.Errorf("CASSANDRA_ADDRESS must be set")
+	}
+	cfg.Addresses = []string{addr}
+
+	if v := os.Getenv("CASSANDRA_PORT"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &cfg.Port); err != nil {
+			return Config{}, fmt.Errorf("invalid CASSANDRA_PORT %q: %s", v, err)
+		}
+	}
+
+	if v := os.Getenv("CASSANDRA_KEYSPACE"); v != "" {
+		cfg.Keyspace = v
+	}
+
+	if v := os.Getenv("CASSANDRA_NUM_CONNS"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &cfg.NumConns); err != nil {
+			return Config{}, fmt.Errorf("invalid CASSANDRA_NUM_CONNS %q: %s", v, err)
+		}
+	}
+
+	if v := os.Getenv("CASSANDRA_USERNAME"); v != "" {
+		cfg.Auth.Username = v
+		cfg.Auth.Password = os.Getenv("CASSANDRA_PASSWORD")
+	}
+
+	if os.Getenv("CASSANDRA_TLS_ENABLED") == "true" {
+		cfg.TLS = TLSConfig{
+			Enabled:                true,
+			CAPath:                 os.Getenv("CASSANDRA_TLS_CA"),
+			CertPath:               os.Getenv("CASSANDRA_TLS_CERT"),
+			KeyPath:                os.Getenv("CASSANDRA_TLS_KEY"),
+			EnableHostVerification: os.Getenv("CASSANDRA_TLS_INSECURE_SKIP_VERIFY") != "true",
+		}
+	}
+
+	cfg.DisableInitialHostLookup = os.Getenv("CASSANDRA_DISABLE_INITIAL_HOST_LOOKUP") == "true"
+
+	return cfg, nil
+}
+
+// applyTo wires cfg's TLS settings onto a gocql.ClusterConfig.
+func (t TLSConfig) applyTo(cluster *gocql.ClusterConfig) error {
+	if !t.Enabled {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: !t.EnableHostVerification}
+
+	if t.CertPath != "" && t.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertPath, t.KeyPath)
+		if err != nil {
+			return fmt.Errorf("loading client cert/key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CAPath != "" {
+		caCert, err := os.ReadFile(t.CAPath)
+		if err != nil {
+			return fmt.Errorf("reading CA cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s", t.CAPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	cluster.SslOpts = &gocql.SslOptions{
+		Config:                 tlsConfig,
+		EnableHostVerification: t.EnableHostVerification,
+	}
+	return nil
+}
+
+// newClusterConfig builds a *gocql.ClusterConfig from cfg, applying every
+// tuning knob that NewCassandraWithConfig needs before creating a session.
+func newClusterConfig(cfg Config) (*gocql.ClusterConfig, error) {
+	cluster := gocql.NewCluster(cfg.Addresses...)
+	if cfg.Port != 0 {
+		cluster.Port = cfg.Port
+	}
+	cluster.Keyspace = cfg.Keyspace
+	cluster.Consistency = cfg.Consistency
+	cluster.NumConns = cfg.NumConns
+	cluster.ProtoVersion = cfg.ProtoVersion
+	cluster.DisableInitialHostLookup = cfg.DisableInitialHostLookup
+
+	if cfg.HostSelection != nil {
+		cluster.PoolConfig.HostSelectionPolicy = cfg.HostSelection
+	}
+
+	if cfg.Auth.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cfg.Auth.Username,
+			Password: cfg.Auth.Password,
+		}
+	}
+
+	if err := cfg.TLS.applyTo(cluster); err != nil {
+		return nil, err
+	}
+
+	return cluster, nil
+}
@@ -1,70 +1,148 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 
 	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timo672009/caas/migrations"
 )
 
 type DB interface {
 	IncrementAndGet(counterName string) (Counter, error)
+	IncrementAndGetBatch(names []string) ([]Counter, error)
 }
 
 type cassandraDB struct {
-	session  *gocql.Session
-	hostname string
+	supervisor *sessionSupervisor
+	hostname   string
+
+	retryPolicy    *backoffRetryPolicy
+	specExecPolicy *backoffSpeculativeExecutionPolicy
+	metrics        *queryMetrics
 }
 
+// NewCassandra builds a Config from the environment and connects with it,
+// preserving caas's historical env-only configuration surface. Operators
+// that need TLS, auth, or cluster tuning should use NewCassandraWithConfig
+// directly.
 func NewCassandra() (DB, error) {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewCassandraWithConfig(cfg)
+}
+
+// NewCassandraWithConfig connects to Cassandra using cfg, resolving
+// cfg.Addresses via DNS the same way NewCassandra always has, then
+// creating the keyspace/tables and a tuned session. The session is held
+// behind a sessionSupervisor, which rebuilds it (re-resolving addresses and
+// re-running migrations) if health checks start failing, so a stale DNS
+// record or a cluster restart doesn't require restarting caas.
+func NewCassandraWithConfig(cfg Config) (DB, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
-	addr := os.Getenv("CASSANDRA_ADDRESS")
-	if addr == "" {
-		return nil, fmt.Errorf("CASSANDRA_ADDRESS must be set")
+	if len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("Config.Addresses must not be empty")
+	}
+
+	registerer := cfg.Metrics.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	gatherer := cfg.Metrics.Gatherer
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	metrics := newQueryMetrics(registerer, cfg.NumConns)
+
+	if cfg.Metrics.ListenAddr != "" {
+		serveMetrics(cfg.Metrics.ListenAddr, gatherer)
 	}
 
-	// We need to resolve all IPs of cassandra server and connect to them
-	ips, err := net.LookupHost(addr)
+	session, err := buildSession(cfg, metrics)
 	if err != nil {
-		return nil, fmt.Errorf("cannot resolve %s: %s", addr, err)
+		return nil, err
 	}
 
-	log.Printf("Resolved cassandra address %s to %+v", addr, ips)
+	supervisor := newSessionSupervisor(cfg, metrics, session)
+	go supervisor.run()
+
+	return &cassandraDB{
+		supervisor:     supervisor,
+		hostname:       hostname,
+		retryPolicy:    newBackoffRetryPolicy(cfg.Retry),
+		specExecPolicy: newBackoffSpeculativeExecutionPolicy(cfg.Retry),
+		metrics:        metrics,
+	}, nil
+}
+
+// buildSession resolves cfg.Addresses via DNS, creates the keyspace if
+// needed, and opens a tuned session with migrations applied. It is used
+// both for the initial connect and by sessionSupervisor when rebuilding
+// after a health-check failure.
+func buildSession(cfg Config, metrics *queryMetrics) (*gocql.Session, error) {
+	var ips []string
+	for _, addr := range cfg.Addresses {
+		resolved, err := net.LookupHost(addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %s", addr, err)
+		}
+		ips = append(ips, resolved...)
+	}
+	log.Printf("Resolved cassandra addresses %v to %+v", cfg.Addresses, ips)
 
-	if err := createKeyspace(ips); err != nil {
+	resolvedCfg := cfg
+	resolvedCfg.Addresses = ips
+
+	if err := createKeyspace(resolvedCfg); err != nil {
 		return nil, err
 	}
 
-	cluster := gocql.NewCluster(ips...)
-	cluster.Keyspace = "caas"
+	cluster, err := newClusterConfig(resolvedCfg)
+	if err != nil {
+		return nil, err
+	}
+	cluster.ConnectObserver = newQueryLogger(metrics)
 
 	session, err := cluster.CreateSession()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := createTables(session); err != nil {
-		return nil, err
+	if err := migrations.New(session, cfg.Keyspace).Up(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("running migrations: %s", err)
 	}
-	return &cassandraDB{session, hostname}, nil
+
+	return session, nil
 }
 
-func createKeyspace(ips []string) error {
-	cluster := gocql.NewCluster(ips...)
+func createKeyspace(cfg Config) error {
+	cluster, err := newClusterConfig(cfg)
+	if err != nil {
+		return err
+	}
+	cluster.Keyspace = ""
+
 	session, err := cluster.CreateSession()
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
-	cql := "CREATE KEYSPACE IF NOT EXISTS caas WITH replication = {'class': 'SimpleStrategy', 'replication_factor' : 3};"
+	cql := fmt.Sprintf(
+		"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': '%s', 'replication_factor' : %d};",
+		cfg.Keyspace, cfg.ReplicationClass, cfg.ReplicationFactor,
+	)
 	query := session.Query(cql)
 	if err := query.Exec(); err != nil {
 		log.Printf("error creating keyspace: %s", err)
@@ -74,25 +152,23 @@ func createKeyspace(ips []string) error {
 	return nil
 }
 
-func createTables(session *gocql.Session) error {
-	cql := "CREATE TABLE IF NOT EXISTS counter (name text, value counter, PRIMARY KEY (name))"
-	query := session.Query(cql)
-	if err := query.Exec(); err != nil {
-		log.Printf("error creating table: %s", err)
-		return err
-	}
-	log.Printf("table created")
-	return nil
-}
-
 func (c *cassandraDB) IncrementAndGet(counterName string) (Counter, error) {
-	observer := &queryLogger{}
-	err := c.increment(counterName, observer)
-	if err != nil {
+	observer := newQueryLogger(c.metrics)
+
+	// The counter UPDATE is not idempotent, so it is issued once against
+	// whichever session is current right now rather than through
+	// withSession: retrying it across a session transition would risk
+	// re-executing it and double-counting.
+	if err := c.increment(c.supervisor.Session(), counterName, observer); err != nil {
 		return Counter{}, fmt.Errorf("error incrementing %q: %s", counterName, err)
 	}
 
-	count, err := c.get(counterName, observer)
+	var count int64
+	err := c.supervisor.withSession(func(session *gocql.Session) error {
+		var err error
+		count, err = c.get(session, counterName, observer)
+		return err
+	})
 	if err != nil {
 		return Counter{}, fmt.Errorf("error getting %q: %s", counterName, err)
 	}
@@ -100,39 +176,25 @@ func (c *cassandraDB) IncrementAndGet(counterName string) (Counter, error) {
 	return Counter{Value: count, Name: counterName, Host: c.hostname, DBStats: observer.stats}, nil
 }
 
-func (c *cassandraDB) increment(name string, observer gocql.QueryObserver) error {
-	query := c.session.Query(`UPDATE counter SET value=value+1 WHERE name = ?`, name)
-	query.Observer(observer).RetryPolicy(&gocql.SimpleRetryPolicy{NumRetries: 5})
+func (c *cassandraDB) increment(session *gocql.Session, name string, observer gocql.QueryObserver) error {
+	// Counter writes are not idempotent, so speculative execution is never
+	// enabled here even when c.specExecPolicy.cfg.Speculative is set.
+	query := session.Query(`UPDATE counter SET value=value+1 WHERE name = ?`, name)
+	query.Observer(observer).RetryPolicy(c.retryPolicy)
 	return query.Exec()
 }
 
-func (c *cassandraDB) get(name string, observer gocql.QueryObserver) (count int64, err error) {
+func (c *cassandraDB) get(session *gocql.Session, name string, observer gocql.QueryObserver) (count int64, err error) {
 	m := map[string]interface{}{}
 	cql := "SELECT name, value FROM counter WHERE name=? LIMIT 1"
-	query := c.session.Query(cql, name).Consistency(gocql.One)
-	query.Observer(observer).RetryPolicy(&gocql.SimpleRetryPolicy{NumRetries: 5})
+	// No per-query Consistency() override here: the session already carries
+	// cfg.Consistency from newClusterConfig, and overriding it to a fixed
+	// value would silence the Config knob that's supposed to control this.
+	query := session.Query(cql, name).Idempotent(true)
+	query.Observer(observer).RetryPolicy(c.retryPolicy).SpeculativeExecutionPolicy(c.specExecPolicy)
 	if err := query.MapScan(m); err != nil {
 		return 0, err
 	}
 	return m["value"].(int64), nil
 }
 
-type queryLogger struct {
-	stats []QueryStat
-}
-
-var _ gocql.QueryObserver = &queryLogger{}
-
-func (q *queryLogger) ObserveQuery(_ context.Context, query gocql.ObservedQuery) {
-	if q.stats == nil {
-		q.stats = []QueryStat{}
-	}
-	stat := QueryStat{
-		Statement: query.Statement,
-		Attempts:  query.Metrics.Attempts,
-		Time:      fmt.Sprintf("%f miliseconds", query.End.Sub(query.Start).Seconds()*1000),
-		Host:      query.Host.ConnectAddress().String(),
-		Rows:      query.Rows,
-	}
-	q.stats = append(q.stats, stat)
-}
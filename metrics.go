@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsConfig controls where caas's Prometheus metrics are registered and
+// how they're exposed.
+type MetricsConfig struct {
+	// Registerer defaults to prometheus.DefaultRegisterer when nil.
+	Registerer prometheus.Registerer
+	// Gatherer defaults to prometheus.DefaultGatherer when nil. It should
+	// gather from the same registry Registerer registers into.
+	Gatherer prometheus.Gatherer
+
+	// ListenAddr, if set, makes NewCassandraWithConfig start an HTTP server
+	// on this address serving Gatherer at /metrics. Leave empty to mount
+	// /metrics on an existing server with MetricsHandler instead.
+	ListenAddr string
+}
+
+// statementKind is a bounded label for the kind of CQL statement a query
+// observation is for. It is derived from the statement text rather than
+// using the text itself as a label, so that per-statement metrics can't
+// suffer a cardinality explosion from bind values or ad-hoc queries.
+type statementKind string
+
+const (
+	statementIncrement statementKind = "increment"
+	statementSelect    statementKind = "select"
+	statementOther     statementKind = "other"
+)
+
+func classifyStatement(statement string) statementKind {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return statementOther
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "UPDATE":
+		return statementIncrement
+	case "SELECT":
+		return statementSelect
+	default:
+		return statementOther
+	}
+}
+
+// queryMetrics holds the Prometheus collectors shared by every queryLogger
+// created for a single cassandraDB, so that per-call observers contribute
+// to the same series instead of each registering their own.
+type queryMetrics struct {
+	queryDuration *prometheus.HistogramVec
+	queryAttempts *prometheus.CounterVec
+	queryRetries  *prometheus.CounterVec
+	connectErrors *prometheus.CounterVec
+	poolSize      *prometheus.GaugeVec
+
+	// numConns is the configured per-host pool size. gocql doesn't expose
+	// live per-host connection counts through the session, so poolSize
+	// reports this target value rather than the true in-flight count.
+	numConns int
+}
+
+func newQueryMetrics(reg prometheus.Registerer, numConns int) *queryMetrics {
+	m := &queryMetrics{
+		numConns: numConns,
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "caas",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of Cassandra queries and batches observed by caas, by statement kind and host.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"statement", "host"}),
+		queryAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "caas",
+			Name:      "query_attempts_total",
+			Help:      "Total attempts (including retries) made per statement kind.",
+		}, []string{"statement"}),
+		queryRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "caas",
+			Name:      "query_retries_total",
+			Help:      "Total retried attempts per statement kind.",
+		}, []string{"statement"}),
+		connectErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "caas",
+			Name:      "connect_errors_total",
+			Help:      "Total connection errors observed per host.",
+		}, []string{"host"}),
+		poolSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "caas",
+			Name:      "pool_size",
+			Help:      "Configured connection pool size per host, sampled on each connect observation.",
+		}, []string{"host"}),
+	}
+
+	reg.MustRegister(m.queryDuration, m.queryAttempts, m.queryRetries, m.connectErrors, m.poolSize)
+	return m
+}
+
+// MetricsHandler returns an http.Handler serving the metrics registered on
+// gatherer in the Prometheus exposition format, for mounting at /metrics.
+// Pass prometheus.DefaultGatherer when Config.Metrics.Registerer was left
+// at its default.
+func MetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// serveMetrics starts an HTTP server on addr exposing gatherer at /metrics,
+// used when Config.Metrics.ListenAddr is set. A caller that already runs an
+// HTTP server for the rest of caas's API should mount MetricsHandler on it
+// directly instead of setting ListenAddr.
+func serveMetrics(addr string, gatherer prometheus.Gatherer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(gatherer))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server on %s stopped: %s", addr, err)
+		}
+	}()
+}
+
+// queryLogger is a gocql.QueryObserver, gocql.BatchObserver, and
+// gocql.ConnectObserver. It collects the QueryStats returned in a single
+// IncrementAndGet call's response payload, and also records Prometheus
+// metrics into the cassandraDB-wide queryMetrics it was built with.
+type queryLogger struct {
+	mu      sync.Mutex
+	stats   []QueryStat
+	metrics *queryMetrics
+}
+
+func newQueryLogger(metrics *queryMetrics) *queryLogger {
+	return &queryLogger{metrics: metrics}
+}
+
+var (
+	_ gocql.QueryObserver   = &queryLogger{}
+	_ gocql.BatchObserver   = &queryLogger{}
+	_ gocql.ConnectObserver = &queryLogger{}
+)
+
+// ObserveQuery may be called concurrently: getBatch gives each goroutine its
+// own observer, but speculative executions of one SELECT report to the same
+// observer in parallel, so stats is guarded by mu.
+func (q *queryLogger) ObserveQuery(_ context.Context, query gocql.ObservedQuery) {
+	stat := QueryStat{
+		Statement: query.Statement,
+		Attempts:  query.Metrics.Attempts,
+		Time:      fmt.Sprintf("%f miliseconds", query.End.Sub(query.Start).Seconds()*1000),
+		Host:      query.Host.ConnectAddress().String(),
+		Rows:      query.Rows,
+	}
+
+	q.mu.Lock()
+	q.stats = append(q.stats, stat)
+	q.mu.Unlock()
+
+	if q.metrics == nil {
+		return
+	}
+	kind := classifyStatement(query.Statement)
+	host := query.Host.ConnectAddress().String()
+	q.metrics.queryDuration.WithLabelValues(string(kind), host).Observe(query.End.Sub(query.Start).Seconds())
+	q.metrics.queryAttempts.WithLabelValues(string(kind)).Add(float64(query.Metrics.Attempts))
+	if query.Metrics.Attempts > 1 {
+		q.metrics.queryRetries.WithLabelValues(string(kind)).Add(float64(query.Metrics.Attempts - 1))
+	}
+}
+
+// ObserveBatch records the counter batch used by IncrementAndGetBatch.
+// Batches are only ever used for the counter increment, so the statement
+// label is always "increment".
+func (q *queryLogger) ObserveBatch(_ context.Context, batch gocql.ObservedBatch) {
+	if q.metrics == nil {
+		return
+	}
+	host := batch.Host.ConnectAddress().String()
+	q.metrics.queryDuration.WithLabelValues(string(statementIncrement), host).Observe(batch.End.Sub(batch.Start).Seconds())
+	q.metrics.queryAttempts.WithLabelValues(string(statementIncrement)).Add(float64(batch.Metrics.Attempts))
+	if batch.Metrics.Attempts > 1 {
+		q.metrics.queryRetries.WithLabelValues(string(statementIncrement)).Add(float64(batch.Metrics.Attempts - 1))
+	}
+}
+
+// ObserveConnect records connection errors and samples the pool size gauge
+// for the host being connected to.
+func (q *queryLogger) ObserveConnect(connect gocql.ObservedConnect) {
+	if q.metrics == nil {
+		return
+	}
+	host := connect.Host.ConnectAddress().String()
+	if connect.Err != nil {
+		q.metrics.connectErrors.WithLabelValues(host).Inc()
+		return
+	}
+	q.metrics.poolSize.WithLabelValues(host).Set(float64(q.metrics.numConns))
+}
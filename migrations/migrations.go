@@ -0,0 +1,328 @@
+// Package migrations manages schema evolution for the caas keyspace. It
+// tracks applied versions in a schema_migrations table and applies ordered
+// .cql files, modeled on golang-migrate's cassandra driver.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//go:embed sql/*.cql
+var defaultFS embed.FS
+
+const migrationsTable = "schema_migrations"
+
+// lockVersion is a reserved row in migrationsTable used purely as an
+// advisory lock between concurrently starting runners; it is never a real
+// migration version.
+const lockVersion = 0
+
+const (
+	// lockTTL bounds how long a lock row survives, so a runner that crashes
+	// mid-migration doesn't wedge every future startup behind a lock no one
+	// will ever release.
+	lockTTL = 60 * time.Second
+
+	// lockWaitTimeout and lockPollInterval let a losing runner wait for the
+	// current lock holder to finish and release it, instead of failing
+	// startup outright the first time the lock is contended. This must
+	// stay longer than lockTTL, otherwise a waiter gives up before a
+	// crashed holder's lock row has even had a chance to expire.
+	lockWaitTimeout  = 90 * time.Second
+	lockPollInterval = 500 * time.Millisecond
+)
+
+// Migrator applies versioned .cql migrations against a keyspace, tracking
+// progress in migrationsTable (version bigint PRIMARY KEY, dirty boolean,
+// applied_at timestamp).
+type Migrator struct {
+	session  *gocql.Session
+	keyspace string
+	fs       fs.FS
+}
+
+// New returns a Migrator that reads its .cql files from the migrations
+// embedded with the package.
+func New(session *gocql.Session, keyspace string) *Migrator {
+	return NewWithFS(session, keyspace, defaultFS)
+}
+
+// NewWithFS is New but with an explicit source of migration files.
+func NewWithFS(session *gocql.Session, keyspace string, migrationFS fs.FS) *Migrator {
+	return &Migrator{session: session, keyspace: keyspace, fs: migrationFS}
+}
+
+// direction is up or down.
+type direction string
+
+const (
+	up   direction = "up"
+	down direction = "down"
+)
+
+// file is one parsed entry from the sql directory, e.g.
+// 0001_create_counter_table.up.cql.
+type file struct {
+	version int
+	name    string
+	dir     direction
+}
+
+// ensureTable creates migrationsTable if it doesn't already exist.
+func (m *Migrator) ensureTable() error {
+	cql := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.%s (version bigint PRIMARY KEY, dirty boolean, applied_at timestamp)`,
+		m.keyspace, migrationsTable,
+	)
+	return m.session.Query(cql).Exec()
+}
+
+// lock acquires the advisory lock row via a lightweight-transaction insert,
+// so that only one runner applies migrations at a time. The row carries a
+// TTL so a runner that crashes before calling unlock doesn't hold the lock
+// forever, and lock retries for up to lockWaitTimeout so a runner that
+// loses the race waits for the current holder to finish instead of failing
+// startup immediately.
+func (m *Migrator) lock() error {
+	cql := fmt.Sprintf(
+		`INSERT INTO %s.%s (version, dirty) VALUES (?, false) IF NOT EXISTS USING TTL %d`,
+		m.keyspace, migrationsTable, int(lockTTL.Seconds()),
+	)
+
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		applied, err := m.session.Query(cql, lockVersion).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return fmt.Errorf("acquiring migration lock: %s", err)
+		}
+		if applied {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("migrations: timed out after %s waiting for another runner's lock", lockWaitTimeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (m *Migrator) unlock() error {
+	cql := fmt.Sprintf(`DELETE FROM %s.%s WHERE version = ?`, m.keyspace, migrationsTable)
+	return m.session.Query(cql, lockVersion).Exec()
+}
+
+// checkDirty refuses to proceed if a previous run left a version dirty,
+// since we don't know whether that migration partially applied.
+func (m *Migrator) checkDirty() error {
+	cql := fmt.Sprintf(`SELECT version FROM %s.%s WHERE dirty = true ALLOW FILTERING`, m.keyspace, migrationsTable)
+	iter := m.session.Query(cql).Iter()
+	defer iter.Close()
+
+	var version int64
+	if iter.Scan(&version) {
+		return fmt.Errorf("migrations: database is dirty at version %d, run Force to recover", version)
+	}
+	return iter.Close()
+}
+
+// Version returns the highest applied, non-lock migration version, or -1 if
+// none have been applied yet.
+func (m *Migrator) Version() (int64, error) {
+	if err := m.ensureTable(); err != nil {
+		return 0, err
+	}
+
+	cql := fmt.Sprintf(`SELECT version FROM %s.%s WHERE dirty = false ALLOW FILTERING`, m.keyspace, migrationsTable)
+	iter := m.session.Query(cql).Iter()
+	defer iter.Close()
+
+	version := int64(-1)
+	var v int64
+	for iter.Scan(&v) {
+		if v != lockVersion && v > version {
+			version = v
+		}
+	}
+	return version, iter.Close()
+}
+
+// Force marks version as applied and clean without running its migration,
+// for recovering from a dirty database after a manual fix.
+func (m *Migrator) Force(version int64) error {
+	if err := m.ensureTable(); err != nil {
+		return err
+	}
+	cql := fmt.Sprintf(
+		`INSERT INTO %s.%s (version, dirty, applied_at) VALUES (?, false, toTimestamp(now()))`,
+		m.keyspace, migrationsTable,
+	)
+	return m.session.Query(cql, version).Exec()
+}
+
+// Up applies every pending migration, in order, after the currently
+// recorded version.
+func (m *Migrator) Up() error {
+	return m.run(up)
+}
+
+// Down reverts every applied migration, in reverse order, down to nothing.
+func (m *Migrator) Down() error {
+	return m.run(down)
+}
+
+func (m *Migrator) run(dir direction) error {
+	if err := m.ensureTable(); err != nil {
+		return err
+	}
+	if err := m.lock(); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	if err := m.checkDirty(); err != nil {
+		return err
+	}
+
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	files, err := loadFiles(m.fs, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if dir == up && int64(f.version) <= current {
+			continue
+		}
+		if dir == down && int64(f.version) > current {
+			continue
+		}
+
+		if err := m.apply(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply marks f's version dirty, executes its statements, then marks it
+// clean (for up) or removes it (for down).
+func (m *Migrator) apply(f file) error {
+	dirtyCQL := fmt.Sprintf(`INSERT INTO %s.%s (version, dirty) VALUES (?, true)`, m.keyspace, migrationsTable)
+	if err := m.session.Query(dirtyCQL, f.version).Exec(); err != nil {
+		return fmt.Errorf("marking version %d dirty: %s", f.version, err)
+	}
+
+	body, err := fs.ReadFile(m.fs, "sql/"+f.name)
+	if err != nil {
+		return fmt.Errorf("reading migration %s: %s", f.name, err)
+	}
+
+	for _, stmt := range splitStatements(string(body)) {
+		if err := m.session.Query(stmt).Exec(); err != nil {
+			return fmt.Errorf("applying %s: %s", f.name, err)
+		}
+	}
+
+	if f.dir == up {
+		cleanCQL := fmt.Sprintf(
+			`INSERT INTO %s.%s (version, dirty, applied_at) VALUES (?, false, toTimestamp(now()))`,
+			m.keyspace, migrationsTable,
+		)
+		if err := m.session.Query(cleanCQL, f.version).Exec(); err != nil {
+			return fmt.Errorf("marking version %d clean: %s", f.version, err)
+		}
+		return nil
+	}
+
+	removeCQL := fmt.Sprintf(`DELETE FROM %s.%s WHERE version = ?`, m.keyspace, migrationsTable)
+	if err := m.session.Query(removeCQL, f.version).Exec(); err != nil {
+		return fmt.Errorf("removing version %d record: %s", f.version, err)
+	}
+	return nil
+}
+
+// loadFiles reads the sql directory of fsys and returns the files matching
+// dir ("up" or "down"), sorted ascending for up and descending for down.
+func loadFiles(fsys fs.FS, dir direction) ([]file, error) {
+	entries, err := fs.ReadDir(fsys, "sql")
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations directory: %s", err)
+	}
+
+	var files []file
+	suffix := "." + string(dir) + ".cql"
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+
+		versionStr, _, ok := strings.Cut(entry.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is missing a version prefix", entry.Name())
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version prefix: %s", entry.Name(), err)
+		}
+
+		files = append(files, file{version: version, name: entry.Name(), dir: dir})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if dir == up {
+			return files[i].version < files[j].version
+		}
+		return files[i].version > files[j].version
+	})
+	return files, nil
+}
+
+// splitStatements splits a .cql file's body on semicolons, ignoring any
+// semicolon that appears inside a single- or double-quoted string, so that
+// a migration file can contain more than one CQL statement.
+func splitStatements(body string) []string {
+	var statements []string
+	var current strings.Builder
+	var quote rune
+
+	for _, r := range body {
+		switch {
+		case quote != 0:
+			current.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			current.WriteRune(r)
+		case r == ';':
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+
+	var nonEmpty []string
+	for _, s := range statements {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return nonEmpty
+}
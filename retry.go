@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// RetryConfig tunes backoffRetryPolicy and backoffSpeculativeExecutionPolicy.
+type RetryConfig struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+
+	MaxAttempts int
+
+	// Speculative enables speculative execution for idempotent queries
+	// (the SELECT path). It never applies to counter updates, since a
+	// speculative retry of a non-idempotent write could double-apply it.
+	Speculative      bool
+	SpeculativeDelay time.Duration
+}
+
+// defaultRetryConfig mirrors the NumRetries: 5 caas has always used, with
+// added backoff/jitter and speculative execution left off by default.
+func defaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		BaseDelay:        50 * time.Millisecond,
+		MaxDelay:         2 * time.Second,
+		Multiplier:       2,
+		MaxAttempts:      6, // NumRetries: 5 plus the first attempt
+		Speculative:      false,
+		SpeculativeDelay: 100 * time.Millisecond,
+	}
+}
+
+// backoff computes the delay to wait after the given number of attempts
+// (1-indexed) before making the next one, using exponential backoff with
+// full jitter: a uniformly random duration in
+// [0, min(MaxDelay, BaseDelay*Multiplier^(attempt-1))).
+func (cfg RetryConfig) backoff(attempt int) time.Duration {
+	delay := float64(cfg.BaseDelay) * math.Pow(cfg.Multiplier, float64(attempt-1))
+	if delay > float64(cfg.MaxDelay) {
+		delay = float64(cfg.MaxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// backoffRetryPolicy is a gocql.RetryPolicy with exponential backoff and
+// full jitter between attempts, and classification of retryable errors:
+// Unavailable and ReadTimeout are retried (both safe to retry on a read),
+// as is WriteTimeout for non-counter writes, but a WriteTimeout on a
+// counter update is rethrown, since counter writes are not idempotent and
+// retrying risks double-incrementing.
+type backoffRetryPolicy struct {
+	cfg RetryConfig
+}
+
+func newBackoffRetryPolicy(cfg RetryConfig) *backoffRetryPolicy {
+	return &backoffRetryPolicy{cfg: cfg}
+}
+
+var _ gocql.RetryPolicy = &backoffRetryPolicy{}
+
+// Attempt allows up to cfg.MaxAttempts attempts in total. q.Attempts()
+// reports how many attempts have already been made, so attempt N is only
+// allowed while N < MaxAttempts (the case N == MaxAttempts would be the
+// (MaxAttempts+1)'th attempt).
+func (p *backoffRetryPolicy) Attempt(q gocql.RetryableQuery) bool {
+	attempt := q.Attempts()
+	if attempt >= p.cfg.MaxAttempts {
+		return false
+	}
+	time.Sleep(p.cfg.backoff(attempt))
+	return true
+}
+
+func (p *backoffRetryPolicy) GetRetryType(err error) gocql.RetryType {
+	switch e := err.(type) {
+	case *gocql.RequestErrWriteTimeout:
+		if e.WriteType == "COUNTER" {
+			return gocql.Rethrow
+		}
+		return gocql.Retry
+	case *gocql.RequestErrReadTimeout:
+		return gocql.Retry
+	case *gocql.RequestErrUnavailable:
+		return gocql.Retry
+	default:
+		return gocql.Rethrow
+	}
+}
+
+// backoffSpeculativeExecutionPolicy is a gocql.SpeculativeExecutionPolicy
+// built on the same RetryConfig as backoffRetryPolicy, so both are tuned
+// together. It is only attached to idempotent queries (the SELECT path);
+// counter updates never have it attached, and Attempt also refuses any
+// query not marked idempotent, whatever cfg.Speculative is set to.
+type backoffSpeculativeExecutionPolicy struct {
+	cfg RetryConfig
+}
+
+func newBackoffSpeculativeExecutionPolicy(cfg RetryConfig) *backoffSpeculativeExecutionPolicy {
+	return &backoffSpeculativeExecutionPolicy{cfg: cfg}
+}
+
+var _ gocql.SpeculativeExecutionPolicy = &backoffSpeculativeExecutionPolicy{}
+
+func (p *backoffSpeculativeExecutionPolicy) Attempt(q gocql.ExecutableQuery) bool {
+	return p.cfg.Speculative && q.IsIdempotent()
+}
+
+func (p *backoffSpeculativeExecutionPolicy) Delay() time.Duration {
+	return p.cfg.SpeculativeDelay
+}
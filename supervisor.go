@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	// healthCheckInterval is how often the supervisor pings the cluster.
+	healthCheckInterval = 30 * time.Second
+
+	// healthCheckFailureThreshold is how many consecutive failed pings
+	// trigger a session rebuild.
+	healthCheckFailureThreshold = 3
+
+	// transitionRetries and transitionRetryDelay bound how long a caller
+	// waits for a session rebuild to land before giving up, so a request
+	// made mid-reconnect doesn't fail outright.
+	transitionRetries    = 3
+	transitionRetryDelay = 200 * time.Millisecond
+
+	// oldSessionDrainDelay is how long reconnect waits before closing the
+	// session it just replaced. A caller may have already loaded the old
+	// pointer and be mid-query when the swap happens, and withSession's
+	// retry only covers gocql.ErrNoConnections, not the error Close()
+	// produces out from under an in-flight query — so closing immediately
+	// would trade one failure mode for another. This delay needs to be
+	// comfortably longer than transitionRetries*transitionRetryDelay plus
+	// any query the old session could still be running.
+	oldSessionDrainDelay = 10 * time.Second
+)
+
+// sessionSupervisor holds a *gocql.Session behind an atomic pointer and
+// periodically health-checks it, rebuilding the session (re-resolving
+// cfg.Addresses and re-running migrations) after repeated failures. This
+// lets a stale DNS record or a full cluster restart recover without
+// restarting the caas process: in-flight callers pick up the new session
+// through Session()/withSession the next time they read the pointer.
+type sessionSupervisor struct {
+	cfg     Config
+	metrics *queryMetrics
+
+	current atomic.Pointer[gocql.Session]
+	stop    chan struct{}
+}
+
+func newSessionSupervisor(cfg Config, metrics *queryMetrics, session *gocql.Session) *sessionSupervisor {
+	s := &sessionSupervisor{cfg: cfg, metrics: metrics, stop: make(chan struct{})}
+	s.current.Store(session)
+	return s
+}
+
+// Session returns the currently active session. It may be swapped out for
+// a new one concurrently, so callers should reread it rather than holding
+// on to a session across a retry.
+func (s *sessionSupervisor) Session() *gocql.Session {
+	return s.current.Load()
+}
+
+// Close stops the health-check loop. It does not close the underlying
+// session, which callers may still be using.
+func (s *sessionSupervisor) Close() {
+	close(s.stop)
+}
+
+// withSession runs fn against the current session, retrying up to
+// transitionRetries times if it fails with gocql.ErrNoConnections, since
+// that's the error a caller sees while a rebuild is in flight. Only wrap
+// idempotent work in fn: a retry here re-runs fn in full, so a non-
+// idempotent write (e.g. the counter UPDATE) must never be passed in, or a
+// transition could make it execute twice. Callers must also return the
+// underlying driver error from fn unwrapped (or wrapped with %w), since
+// wrapping it with %s here would hide it from errors.Is and make this
+// retry dead code.
+func (s *sessionSupervisor) withSession(fn func(session *gocql.Session) error) error {
+	var err error
+	for attempt := 0; attempt <= transitionRetries; attempt++ {
+		err = fn(s.Session())
+		if err == nil || !errors.Is(err, gocql.ErrNoConnections) {
+			return err
+		}
+		time.Sleep(transitionRetryDelay)
+	}
+	return err
+}
+
+func (s *sessionSupervisor) run() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.ping(); err == nil {
+				failures = 0
+				continue
+			} else {
+				failures++
+				log.Printf("session supervisor: health check failed (%d/%d): %s", failures, healthCheckFailureThreshold, err)
+			}
+
+			if failures >= healthCheckFailureThreshold {
+				s.reconnect()
+				failures = 0
+			}
+		}
+	}
+}
+
+func (s *sessionSupervisor) ping() error {
+	return s.Session().Query("SELECT now() FROM system.local").Exec()
+}
+
+// reconnect rebuilds the session from scratch and atomically swaps it in.
+// The old session is closed only after oldSessionDrainDelay, giving callers
+// that already loaded it before the swap a chance to finish their current
+// query rather than have it fail out from under them.
+func (s *sessionSupervisor) reconnect() {
+	log.Printf("session supervisor: rebuilding session after repeated health-check failures")
+
+	session, err := buildSession(s.cfg, s.metrics)
+	if err != nil {
+		log.Printf("session supervisor: failed to rebuild session: %s", err)
+		return
+	}
+
+	old := s.current.Swap(session)
+	time.AfterFunc(oldSessionDrainDelay, old.Close)
+}